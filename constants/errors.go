@@ -0,0 +1,15 @@
+package constants
+
+import "errors"
+
+var ErrStopped = errors.New("stopped")
+var ErrEmptyValue = errors.New("empty value")
+var ErrNoTasksAvailable = errors.New("no tasks available")
+var ErrForbidden = errors.New("forbidden")
+var ErrAlreadyExists = errors.New("already exists")
+var ErrNotExists = errors.New("not exists")
+var ErrInvalidType = errors.New("invalid type")
+var ErrNotImplemented = errors.New("not implemented")
+var ErrTaskError = errors.New("task error")
+var ErrTaskCancelled = errors.New("task cancelled")
+var ErrTaskBlacklisted = errors.New("task blacklisted")
@@ -0,0 +1,10 @@
+package constants
+
+// task (and job) status values, stored on the model.Task document
+const (
+	StatusPending   = "pending"
+	StatusRunning   = "running"
+	StatusError     = "error"
+	StatusFinished  = "finished"
+	StatusCancelled = "cancelled"
+)
@@ -0,0 +1,85 @@
+package model
+
+import (
+	"context"
+	"time"
+
+	"github.com/crawlab-team/crawlab-core/interfaces"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Blacklist is a named rule that TaskService consults before scheduling a
+// task. A rule with more than one matcher set (SpiderPattern, NodeIds,
+// CommitMatcher) only blocks the intersection: e.g. a rule with both
+// SpiderPattern and NodeIds set blocks that spider only on those nodes.
+type Blacklist struct {
+	Id            primitive.ObjectID   `bson:"_id,omitempty" json:"_id"`
+	Name          string               `bson:"name" json:"name"` // unique, <= 50 chars; checked by services/blacklist.BlacklistService.Add
+	SpiderPattern string               `bson:"spider_pattern,omitempty" json:"spider_pattern,omitempty"`
+	NodeIds       []primitive.ObjectID `bson:"node_ids,omitempty" json:"node_ids,omitempty"`
+	CommitMatcher string               `bson:"commit_matcher,omitempty" json:"commit_matcher,omitempty"` // regex matched against Task.Commit
+	ExpireAt      time.Time            `bson:"expire_at,omitempty" json:"expire_at,omitempty"`
+}
+
+func (b *Blacklist) GetId() (id primitive.ObjectID) {
+	return b.Id
+}
+
+func (b *Blacklist) SetId(id primitive.ObjectID) {
+	b.Id = id
+}
+
+// Add inserts the rule, generating an Id if one is not already set.
+func (b *Blacklist) Add() (err error) {
+	col, err := getCol(interfaces.ModelColNameBlacklist)
+	if err != nil {
+		return err
+	}
+
+	if b.Id.IsZero() {
+		b.Id = primitive.NewObjectID()
+	}
+
+	_, err = col.InsertOne(context.Background(), b)
+	return err
+}
+
+// Delete removes the rule by Name.
+func (b *Blacklist) Delete() (err error) {
+	col, err := getCol(interfaces.ModelColNameBlacklist)
+	if err != nil {
+		return err
+	}
+
+	_, err = col.DeleteOne(context.Background(), bson.M{"name": b.Name})
+	return err
+}
+
+// blacklistService implements the Blacklist model's read APIs used by
+// services/blacklist.
+type blacklistService struct{}
+
+// BlacklistService is the package-level accessor for Blacklist persistence.
+var BlacklistService = &blacklistService{}
+
+// GetAll returns every stored blacklist rule, expired or not; callers
+// (services/blacklist) are responsible for filtering by ExpireAt.
+func (svc *blacklistService) GetAll() (rules []Blacklist, err error) {
+	col, err := getCol(interfaces.ModelColNameBlacklist)
+	if err != nil {
+		return nil, err
+	}
+
+	cur, err := col.Find(context.Background(), bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(context.Background())
+
+	if err := cur.All(context.Background(), &rules); err != nil {
+		return nil, err
+	}
+
+	return rules, nil
+}
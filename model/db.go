@@ -0,0 +1,48 @@
+package model
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const defaultMongoUriEnvKey = "CRAWLAB_MONGO_URI"
+const defaultMongoDbEnvKey = "CRAWLAB_MONGO_DB"
+
+var (
+	clientOnce sync.Once
+	client     *mongo.Client
+	clientErr  error
+)
+
+// getCol lazily connects to Mongo (using CRAWLAB_MONGO_URI / CRAWLAB_MONGO_DB,
+// falling back to localhost / crawlab_test) and returns the requested
+// collection. All model CRUD methods go through this so tests can point
+// CRAWLAB_MONGO_URI at an in-memory/ephemeral instance.
+func getCol(name string) (col *mongo.Collection, err error) {
+	clientOnce.Do(func() {
+		uri := os.Getenv(defaultMongoUriEnvKey)
+		if uri == "" {
+			uri = "mongodb://localhost:27017"
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		client, clientErr = mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	})
+	if clientErr != nil {
+		return nil, clientErr
+	}
+
+	dbName := os.Getenv(defaultMongoDbEnvKey)
+	if dbName == "" {
+		dbName = "crawlab_test"
+	}
+
+	return client.Database(dbName).Collection(name), nil
+}
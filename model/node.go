@@ -0,0 +1,19 @@
+package model
+
+import (
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Node represents a master or worker node in the cluster.
+type Node struct {
+	Id   primitive.ObjectID `bson:"_id,omitempty" json:"_id"`
+	Name string             `bson:"name" json:"name"`
+}
+
+func (n *Node) GetId() (id primitive.ObjectID) {
+	return n.Id
+}
+
+func (n *Node) SetId(id primitive.ObjectID) {
+	n.Id = id
+}
@@ -0,0 +1,111 @@
+package model
+
+import (
+	"context"
+	"time"
+
+	"github.com/crawlab-team/crawlab-core/interfaces"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Task represents a single spider run, scheduled and tracked by
+// services.TaskService.
+type Task struct {
+	Id                primitive.ObjectID `bson:"_id,omitempty" json:"_id"`
+	SpiderId          primitive.ObjectID `bson:"spider_id,omitempty" json:"spider_id"`
+	NodeId            primitive.ObjectID `bson:"node_id,omitempty" json:"node_id"`
+	Status            string             `bson:"status" json:"status"`
+	Cmd               string             `bson:"cmd,omitempty" json:"cmd,omitempty"`
+	Commit            string             `bson:"commit,omitempty" json:"commit,omitempty"` // commit/revision of the spider's source at the time this task was run
+	Priority          int                `bson:"priority" json:"priority"`
+	Forced            bool               `bson:"forced" json:"forced"`
+	TriggerSource     string             `bson:"trigger_source,omitempty" json:"trigger_source,omitempty"`
+	RetryCount        int                `bson:"retry_count" json:"retry_count"`
+	BlacklistRuleName string             `bson:"blacklist_rule_name,omitempty" json:"blacklist_rule_name,omitempty"`
+	Error             string             `bson:"error,omitempty" json:"error,omitempty"`
+	CreatedAt         time.Time          `bson:"created_at,omitempty" json:"created_at,omitempty"`
+	UpdatedAt         time.Time          `bson:"updated_at,omitempty" json:"updated_at,omitempty"`
+}
+
+func (t *Task) GetId() (id primitive.ObjectID) {
+	return t.Id
+}
+
+func (t *Task) SetId(id primitive.ObjectID) {
+	t.Id = id
+}
+
+// Add inserts the task, generating an Id if one is not already set.
+func (t *Task) Add() (err error) {
+	col, err := getCol(interfaces.ModelColNameTask)
+	if err != nil {
+		return err
+	}
+
+	if t.Id.IsZero() {
+		t.Id = primitive.NewObjectID()
+	}
+	t.CreatedAt = time.Now()
+	t.UpdatedAt = time.Now()
+
+	_, err = col.InsertOne(context.Background(), t)
+	return err
+}
+
+// Save replaces the stored task document with t.
+func (t *Task) Save() (err error) {
+	col, err := getCol(interfaces.ModelColNameTask)
+	if err != nil {
+		return err
+	}
+
+	t.UpdatedAt = time.Now()
+
+	_, err = col.ReplaceOne(context.Background(), bson.M{"_id": t.Id}, t)
+	return err
+}
+
+// taskService implements the Task model's read APIs used by
+// services.TaskService.
+type taskService struct{}
+
+// TaskService is the package-level accessor for Task persistence, mirroring
+// the other *Service singletons in this package.
+var TaskService = &taskService{}
+
+// GetById fetches a single task by its Id. It returns
+// go.mongodb.org/mongo-driver/mongo.ErrNoDocuments if no task matches.
+func (svc *taskService) GetById(id primitive.ObjectID) (t Task, err error) {
+	col, err := getCol(interfaces.ModelColNameTask)
+	if err != nil {
+		return t, err
+	}
+
+	if err := col.FindOne(context.Background(), bson.M{"_id": id}).Decode(&t); err != nil {
+		return t, err
+	}
+
+	return t, nil
+}
+
+// GetList returns all tasks matching filter, applying opts if given.
+func (svc *taskService) GetList(filter bson.M, opts *options.FindOptions) (tasks []Task, err error) {
+	col, err := getCol(interfaces.ModelColNameTask)
+	if err != nil {
+		return nil, err
+	}
+
+	cur, err := col.Find(context.Background(), filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(context.Background())
+
+	if err := cur.All(context.Background(), &tasks); err != nil {
+		return nil, err
+	}
+
+	return tasks, nil
+}
@@ -0,0 +1,233 @@
+package blacklist
+
+import (
+	"errors"
+	"regexp"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/apex/log"
+	"github.com/crawlab-team/crawlab-core/constants"
+	"github.com/crawlab-team/crawlab-core/model"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// DefaultRefreshInterval is how often the in-memory rule cache is
+// refreshed from MongoDB if not overridden in BlacklistServiceOptions.
+const DefaultRefreshInterval = 30 * time.Second
+
+// MaxRuleNameLength is the longest rule name, in characters, that Add
+// accepts.
+const MaxRuleNameLength = 50
+
+type BlacklistServiceOptions struct {
+	RefreshInterval time.Duration // how often to reload rules from the database, default: 30s
+}
+
+func NewBlacklistService(options *BlacklistServiceOptions) (svc *BlacklistService, err error) {
+	// normalize options
+	if options == nil {
+		options = &BlacklistServiceOptions{}
+	}
+	if options.RefreshInterval == 0 {
+		options.RefreshInterval = DefaultRefreshInterval
+	}
+
+	// construct BlacklistService
+	svc = &BlacklistService{
+		opts: options,
+	}
+
+	// load rules for the first time
+	if err := svc.refresh(); err != nil {
+		return nil, err
+	}
+
+	return svc, nil
+}
+
+// compiledRule pairs a model.Blacklist with its regexes pre-compiled at
+// refresh time, so Match does not recompile them on every call.
+type compiledRule struct {
+	rule     model.Blacklist
+	spiderRe *regexp.Regexp
+	commitRe *regexp.Regexp
+	invalid  bool // a pattern failed to compile; the rule never matches
+}
+
+// BlacklistService consults a set of model.Blacklist rules to decide
+// whether a task is allowed to be scheduled. Rules are cached in memory
+// behind a sync.RWMutex and refreshed on a background loop so Match can
+// be called on the Assign/Fetch hot path without hitting the database.
+type BlacklistService struct {
+	mu     sync.RWMutex
+	rules  []compiledRule
+	active bool
+	opts   *BlacklistServiceOptions
+}
+
+// Init starts the background refresh loop.
+func (svc *BlacklistService) Init() (err error) {
+	svc.active = true
+	go svc.refreshLoop()
+	return nil
+}
+
+// Close stops the background refresh loop.
+func (svc *BlacklistService) Close() {
+	svc.active = false
+}
+
+// Add persists a new blacklist rule and refreshes the in-memory cache. It
+// rejects a name longer than MaxRuleNameLength characters, and a name
+// already present in the cache with constants.ErrAlreadyExists.
+func (svc *BlacklistService) Add(rule model.Blacklist) (err error) {
+	if utf8.RuneCountInString(rule.Name) > MaxRuleNameLength {
+		return errors.New("blacklist rule name is longer than 50 characters")
+	}
+	if _, ok := svc.getByName(rule.Name); ok {
+		return constants.ErrAlreadyExists
+	}
+	if err := rule.Add(); err != nil {
+		return err
+	}
+	return svc.refresh()
+}
+
+// Remove deletes the named blacklist rule and refreshes the in-memory cache.
+func (svc *BlacklistService) Remove(name string) (err error) {
+	rule, ok := svc.getByName(name)
+	if !ok {
+		return constants.ErrNotExists
+	}
+	if err := rule.Delete(); err != nil {
+		return err
+	}
+	return svc.refresh()
+}
+
+// Match returns the first rule (not yet expired) that matches t, if any.
+// A rule's matchers (NodeIds, SpiderPattern, CommitMatcher) are AND'd
+// together: a rule only blocks the intersection of the conditions it sets,
+// e.g. a rule with both SpiderPattern and NodeIds set blocks that spider
+// only on those nodes, not everywhere and not the whole node.
+func (svc *BlacklistService) Match(t model.Task) (rule model.Blacklist, ok bool) {
+	svc.mu.RLock()
+	defer svc.mu.RUnlock()
+
+	now := time.Now()
+	for _, cr := range svc.rules {
+		r := cr.rule
+
+		if cr.invalid {
+			continue
+		}
+
+		if !r.ExpireAt.IsZero() && now.After(r.ExpireAt) {
+			continue
+		}
+
+		if len(r.NodeIds) > 0 && !containsObjectId(r.NodeIds, t.NodeId) {
+			continue
+		}
+
+		if cr.spiderRe != nil && !cr.spiderRe.MatchString(t.SpiderId.Hex()) {
+			continue
+		}
+
+		if cr.commitRe != nil && !cr.commitRe.MatchString(t.Commit) {
+			continue
+		}
+
+		// a rule with no matchers set at all would match every task; that
+		// is never what an operator means by adding a rule, so require at
+		// least one
+		if len(r.NodeIds) == 0 && cr.spiderRe == nil && cr.commitRe == nil {
+			continue
+		}
+
+		return r, true
+	}
+
+	return rule, false
+}
+
+func (svc *BlacklistService) getByName(name string) (rule model.Blacklist, ok bool) {
+	svc.mu.RLock()
+	defer svc.mu.RUnlock()
+	for _, cr := range svc.rules {
+		if cr.rule.Name == name {
+			return cr.rule, true
+		}
+	}
+	return rule, false
+}
+
+func (svc *BlacklistService) refreshLoop() {
+	for svc.active {
+		time.Sleep(svc.opts.RefreshInterval)
+		if !svc.active {
+			return
+		}
+		if err := svc.refresh(); err != nil {
+			log.Error("refresh blacklist rules error: " + err.Error())
+		}
+	}
+}
+
+func (svc *BlacklistService) refresh() (err error) {
+	rules, err := model.BlacklistService.GetAll()
+	if err != nil {
+		return err
+	}
+
+	svc.mu.Lock()
+	svc.rules = compileRules(rules)
+	svc.mu.Unlock()
+
+	return nil
+}
+
+// compileRules pre-compiles each rule's regexes once, so Match does not
+// recompile them on every call on the Assign/Fetch hot path. A rule with
+// an invalid pattern is kept (for expiry/name lookups) but never matches
+// any task.
+func compileRules(rules []model.Blacklist) (compiled []compiledRule) {
+	compiled = make([]compiledRule, 0, len(rules))
+	for _, r := range rules {
+		cr := compiledRule{rule: r}
+
+		if r.SpiderPattern != "" {
+			re, err := regexp.Compile(r.SpiderPattern)
+			if err != nil {
+				log.Error("blacklist rule " + r.Name + ": invalid spider_pattern: " + err.Error())
+				cr.invalid = true
+			} else {
+				cr.spiderRe = re
+			}
+		}
+
+		if r.CommitMatcher != "" {
+			re, err := regexp.Compile(r.CommitMatcher)
+			if err != nil {
+				log.Error("blacklist rule " + r.Name + ": invalid commit_matcher: " + err.Error())
+				cr.invalid = true
+			} else {
+				cr.commitRe = re
+			}
+		}
+
+		compiled = append(compiled, cr)
+	}
+	return compiled
+}
+
+func containsObjectId(ids []primitive.ObjectID, id primitive.ObjectID) (ok bool) {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,90 @@
+package blacklist
+
+import (
+	"testing"
+	"time"
+
+	"github.com/crawlab-team/crawlab-core/model"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestMatchCombinedRuleIsIntersection(t *testing.T) {
+	nodeId := primitive.NewObjectID()
+	otherNodeId := primitive.NewObjectID()
+	spiderId := primitive.NewObjectID()
+	otherSpiderId := primitive.NewObjectID()
+
+	svc := &BlacklistService{
+		rules: compileRules([]model.Blacklist{
+			{
+				Name:          "bad-spider-on-bad-node",
+				SpiderPattern: "^" + spiderId.Hex() + "$",
+				NodeIds:       []primitive.ObjectID{nodeId},
+			},
+		}),
+	}
+
+	// matches: same spider, same node
+	_, ok := svc.Match(model.Task{SpiderId: spiderId, NodeId: nodeId})
+	require.True(t, ok)
+
+	// does not match: same spider, different node
+	_, ok = svc.Match(model.Task{SpiderId: spiderId, NodeId: otherNodeId})
+	require.False(t, ok)
+
+	// does not match: different spider, same node
+	_, ok = svc.Match(model.Task{SpiderId: otherSpiderId, NodeId: nodeId})
+	require.False(t, ok)
+}
+
+func TestMatchExpiredRuleIsIgnored(t *testing.T) {
+	spiderId := primitive.NewObjectID()
+
+	svc := &BlacklistService{
+		rules: compileRules([]model.Blacklist{
+			{
+				Name:          "temporary",
+				SpiderPattern: "^" + spiderId.Hex() + "$",
+				ExpireAt:      time.Now().Add(-time.Minute),
+			},
+		}),
+	}
+
+	_, ok := svc.Match(model.Task{SpiderId: spiderId})
+	require.False(t, ok)
+}
+
+func TestMatchCommitMatcherMatchesTaskCommit(t *testing.T) {
+	svc := &BlacklistService{
+		rules: compileRules([]model.Blacklist{
+			{
+				Name:          "bad-commit",
+				CommitMatcher: "^deadbeef",
+			},
+		}),
+	}
+
+	// matches: commit has the blocked prefix
+	_, ok := svc.Match(model.Task{Commit: "deadbeef123"})
+	require.True(t, ok)
+
+	// does not match: different commit
+	_, ok = svc.Match(model.Task{Commit: "cafef00d"})
+	require.False(t, ok)
+
+	// does not match: Cmd containing the pattern is not enough, only Commit counts
+	_, ok = svc.Match(model.Task{Cmd: "deadbeef run"})
+	require.False(t, ok)
+}
+
+func TestMatchRuleWithNoConditionsNeverMatches(t *testing.T) {
+	svc := &BlacklistService{
+		rules: compileRules([]model.Blacklist{
+			{Name: "empty"},
+		}),
+	}
+
+	_, ok := svc.Match(model.Task{SpiderId: primitive.NewObjectID()})
+	require.False(t, ok)
+}
@@ -0,0 +1,298 @@
+// Command perftest drives services.TaskService at a configurable load so
+// that regressions in Assign/Fetch/Run can be caught before they reach
+// production. It seeds synthetic spiders and tasks across a number of
+// virtual nodes, dispatches them at a target QPS, and reports latency
+// percentiles and throughput as JSON.
+//
+// Mongo and Redis are both ephemeral (see setupFixtures): an in-process
+// miniredis instance and a memongo-managed mongod, neither shared with
+// any real deployment, so the harness is safe to run repeatedly in CI.
+//
+// Example:
+//
+//	go run ./services/perftest -spiders 50 -tasks 10000 -nodes 100 -qps 500 -out report.json
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"runtime/pprof"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/crawlab-team/crawlab-core/constants"
+	"github.com/crawlab-team/crawlab-core/model"
+	"github.com/crawlab-team/crawlab-core/services"
+	"github.com/tryvium-travels/memongo"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func main() {
+	var (
+		numSpiders = flag.Int("spiders", 10, "number of synthetic spiders to seed")
+		numTasks   = flag.Int("tasks", 10000, "number of pending tasks to seed")
+		numNodes   = flag.Int("nodes", 100, "number of virtual worker nodes")
+		qps        = flag.Int("qps", 500, "target Assign/Fetch operations per second")
+		outPath    = flag.String("out", "perftest-report.json", "path to write the JSON report")
+		cpuProfile = flag.String("cpuprofile", "", "write CPU profile to this file")
+		memProfile = flag.String("memprofile", "", "write heap profile to this file")
+	)
+	flag.Parse()
+
+	if *cpuProfile != "" {
+		f, err := os.Create(*cpuProfile)
+		if err != nil {
+			log.Fatalf("create cpu profile: %s", err.Error())
+		}
+		defer f.Close()
+		if err := pprof.StartCPUProfile(f); err != nil {
+			log.Fatalf("start cpu profile: %s", err.Error())
+		}
+		defer pprof.StopCPUProfile()
+	}
+
+	r, err := run(*numSpiders, *numTasks, *numNodes, *qps)
+	if err != nil {
+		log.Fatalf("perftest run failed: %s", err.Error())
+	}
+
+	if *memProfile != "" {
+		f, err := os.Create(*memProfile)
+		if err != nil {
+			log.Fatalf("create mem profile: %s", err.Error())
+		}
+		defer f.Close()
+		if err := pprof.WriteHeapProfile(f); err != nil {
+			log.Fatalf("write mem profile: %s", err.Error())
+		}
+	}
+
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		log.Fatalf("marshal report: %s", err.Error())
+	}
+	if err := os.WriteFile(*outPath, data, 0644); err != nil {
+		log.Fatalf("write report: %s", err.Error())
+	}
+
+	fmt.Printf("wrote report to %s\n", *outPath)
+	fmt.Printf("throughput: %.2f tasks/sec\n", r.ThroughputPerSec)
+}
+
+// Report is the JSON summary emitted after a run, suitable for diffing
+// against a checked-in baseline in CI.
+type Report struct {
+	Spiders          int     `json:"spiders"`
+	Tasks            int     `json:"tasks"`
+	Nodes            int     `json:"nodes"`
+	QPS              int     `json:"qps"`
+	DurationSeconds  float64 `json:"duration_seconds"`
+	ThroughputPerSec float64 `json:"throughput_per_sec"`
+	AssignLatencyMs  Latency `json:"assign_latency_ms"`
+	FetchLatencyMs   Latency `json:"fetch_latency_ms"`
+	QueueTimeMs      Latency `json:"queue_time_ms"`
+}
+
+// Latency holds the p50/p95/p99 of a set of recorded durations, in
+// milliseconds.
+type Latency struct {
+	P50 float64 `json:"p50"`
+	P95 float64 `json:"p95"`
+	P99 float64 `json:"p99"`
+}
+
+func run(numSpiders, numTasks, numNodes, qps int) (r *Report, err error) {
+	cleanup, err := setupFixtures()
+	if err != nil {
+		return nil, fmt.Errorf("set up fixtures: %w", err)
+	}
+	defer cleanup()
+
+	nodes := seedNodes(numNodes)
+	spiderIds := seedSpiders(numSpiders)
+
+	svc, err := services.NewTaskService(&services.TaskServiceOptions{
+		IsMaster: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Init blocks (it runs TaskService's own poll loop), so it needs its
+	// own goroutine; it's what actually starts the taskq consumers and
+	// promoterLoop that Assign/Fetch depend on to dispatch anything
+	go func() {
+		if err := svc.Init(); err != nil && err != constants.ErrStopped {
+			log.Printf("task service init error: %s", err.Error())
+		}
+	}()
+	defer svc.Close()
+
+	var (
+		mu            sync.Mutex
+		assignLatency []time.Duration
+		fetchLatency  []time.Duration
+		queueLatency  []time.Duration
+		wg            sync.WaitGroup
+		limiter       = time.NewTicker(time.Second / time.Duration(qps))
+	)
+	defer limiter.Stop()
+
+	start := time.Now()
+
+	for i := 0; i < numTasks; i++ {
+		<-limiter.C
+
+		t := model.Task{
+			Id:       primitive.NewObjectID(),
+			SpiderId: spiderIds[rand.Intn(len(spiderIds))],
+			NodeId:   nodes[rand.Intn(len(nodes))].Id,
+			Priority: rand.Intn(11),
+		}
+
+		wg.Add(1)
+		go func(t model.Task) {
+			defer wg.Done()
+
+			enqueuedAt := time.Now()
+
+			assignStart := time.Now()
+			if err := svc.Assign(t); err != nil {
+				return
+			}
+			assignDur := time.Since(assignStart)
+
+			fetchStart := time.Now()
+			fetched, err := svc.Fetch()
+			if err != nil {
+				return
+			}
+			fetchDur := time.Since(fetchStart)
+
+			mu.Lock()
+			assignLatency = append(assignLatency, assignDur)
+			fetchLatency = append(fetchLatency, fetchDur)
+			queueLatency = append(queueLatency, time.Since(enqueuedAt))
+			mu.Unlock()
+
+			_ = fetched
+		}(t)
+	}
+
+	wg.Wait()
+	duration := time.Since(start)
+
+	r = &Report{
+		Spiders:          numSpiders,
+		Tasks:            numTasks,
+		Nodes:            numNodes,
+		QPS:              qps,
+		DurationSeconds:  duration.Seconds(),
+		ThroughputPerSec: float64(len(assignLatency)) / duration.Seconds(),
+		AssignLatencyMs:  percentiles(assignLatency),
+		FetchLatencyMs:   percentiles(fetchLatency),
+		QueueTimeMs:      percentiles(queueLatency),
+	}
+
+	return r, nil
+}
+
+// setupFixtures starts an ephemeral miniredis instance and an ephemeral
+// mongod (via memongo), and points model's lazy Mongo client and
+// crawlab-db's redis.RedisClient at them via the same env vars their
+// lazy initializers already read (CRAWLAB_MONGO_URI/CRAWLAB_MONGO_DB, see
+// model/db.go; CRAWLAB_REDIS_ADDRESS for redis.RedisClient). This keeps
+// the harness from ever touching a real cluster's database, so it is
+// safe and reproducible to run in CI.
+//
+// TaskService/queue/blacklist all go through these as package-level
+// singletons rather than an injected client - a pre-existing constraint
+// of their design, not introduced by this harness - so setupFixtures
+// must run, and these env vars must be set, before anything in
+// services/services.NewTaskService touches either client for the first
+// time.
+func setupFixtures() (cleanup func(), err error) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		return nil, fmt.Errorf("start miniredis: %w", err)
+	}
+
+	mongoServer, err := memongo.Start("4.0.5")
+	if err != nil {
+		mr.Close()
+		return nil, fmt.Errorf("start memongo: %w", err)
+	}
+
+	if err := os.Setenv("CRAWLAB_MONGO_URI", memongo.MongoURI(mongoServer)); err != nil {
+		mongoServer.Stop()
+		mr.Close()
+		return nil, err
+	}
+	if err := os.Setenv("CRAWLAB_MONGO_DB", "perftest"); err != nil {
+		mongoServer.Stop()
+		mr.Close()
+		return nil, err
+	}
+	if err := os.Setenv("CRAWLAB_REDIS_ADDRESS", mr.Addr()); err != nil {
+		mongoServer.Stop()
+		mr.Close()
+		return nil, err
+	}
+
+	cleanup = func() {
+		mongoServer.Stop()
+		mr.Close()
+	}
+	return cleanup, nil
+}
+
+func seedNodes(n int) (nodes []model.Node) {
+	for i := 0; i < n; i++ {
+		nodes = append(nodes, model.Node{
+			Id:   primitive.NewObjectID(),
+			Name: fmt.Sprintf("perftest-node-%d", i),
+		})
+	}
+	return nodes
+}
+
+// seedSpiders returns n distinct object ids to vary Task.SpiderId across
+// the synthetic workload. The harness only needs unique identities, not
+// persisted Spider documents.
+func seedSpiders(n int) (ids []primitive.ObjectID) {
+	for i := 0; i < n; i++ {
+		ids = append(ids, primitive.NewObjectID())
+	}
+	return ids
+}
+
+func percentiles(d []time.Duration) (l Latency) {
+	if len(d) == 0 {
+		return l
+	}
+	sorted := make([]time.Duration, len(d))
+	copy(sorted, d)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	ms := func(i int) float64 {
+		return float64(sorted[i].Microseconds()) / 1000
+	}
+	l.P50 = ms(pIndex(len(sorted), 0.50))
+	l.P95 = ms(pIndex(len(sorted), 0.95))
+	l.P99 = ms(pIndex(len(sorted), 0.99))
+	return l
+}
+
+func pIndex(n int, p float64) (i int) {
+	i = int(float64(n) * p)
+	if i >= n {
+		i = n - 1
+	}
+	return i
+}
@@ -0,0 +1,221 @@
+// Package queue wraps github.com/vmihailenco/taskq (redisq backend) to
+// give TaskService retries, delayed delivery, and a dead-letter handler
+// on top of the same Redis instance used elsewhere, instead of the
+// ad-hoc RPush/LPop (and later ZADD/ZPOPMAX) calls it used to make
+// directly.
+package queue
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/crawlab-team/crawlab-core/constants"
+	"github.com/crawlab-team/crawlab-core/model"
+	"github.com/crawlab-team/crawlab-db/redis"
+	"github.com/vmihailenco/taskq/v3"
+	"github.com/vmihailenco/taskq/v3/redisq"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// well-known queue names. "main" replaces the old "tasks:public" queue for
+// tasks with no node affinity; "public" is an overflow queue sized
+// MaxRunners*2. Their consumers run side by side, with no drain order
+// between "public", "main" and the node queues. Node-affinity queues keep the old
+// "tasks:node:<id>" naming and are registered lazily.
+const (
+	QueueNameMain   = "main"
+	QueueNamePublic = "public"
+	nodeQueuePrefix = "tasks:node:"
+)
+
+const taskName = "crawlab.task.dispatch"
+
+// Dispatcher is called with a task id once taskq has reserved it off a
+// queue. TaskService.Init supplies the implementation so this package does
+// not need to know about TaskRunner internals.
+type Dispatcher func(taskId primitive.ObjectID) (err error)
+
+// Options configures the queues registered by Init.
+type Options struct {
+	MaxRunners         int           // sizes "main"; "public" is sized MaxRunners*2, default: 8
+	ReservationTimeout time.Duration // how long a reserved message is hidden before redelivery, default: 5m
+	MaxRetries         int           // retries before a message is treated as dead-lettered, default: 5
+	Dispatch           Dispatcher    // invoked with the task id for each reserved message
+}
+
+var (
+	factory            = redisq.NewFactory()
+	mu                 sync.RWMutex
+	queues             = map[string]*taskq.Queue{}
+	dispatch           Dispatcher
+	maxRunners         = 8
+	reservationTimeout = 5 * time.Minute
+)
+
+// Init registers the "main" and "public" queues and starts their
+// consumers. Node-affinity queues are registered on demand by NodeQueue.
+func Init(opts *Options) (err error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	if opts.MaxRunners == 0 {
+		opts.MaxRunners = 8
+	}
+	if opts.ReservationTimeout == 0 {
+		opts.ReservationTimeout = 5 * time.Minute
+	}
+	if opts.MaxRetries == 0 {
+		opts.MaxRetries = 5
+	}
+
+	dispatch = opts.Dispatch
+	maxRunners = opts.MaxRunners
+	reservationTimeout = opts.ReservationTimeout
+
+	taskq.RegisterTask(&taskq.TaskOptions{
+		Name:            taskName,
+		Handler:         handle,
+		RetryLimit:      opts.MaxRetries,
+		MinBackoff:      time.Second,
+		MaxBackoff:      time.Minute,
+		FallbackHandler: deadLetter,
+	})
+
+	register(QueueNameMain, opts.MaxRunners, opts.ReservationTimeout)
+	register(QueueNamePublic, opts.MaxRunners*2, opts.ReservationTimeout)
+
+	return factory.StartConsumers(context.Background())
+}
+
+// MainQueue returns the "main" queue, registering it lazily (like
+// NodeQueue) so callers that race Init don't see a nil queue.
+func MainQueue() *taskq.Queue {
+	if q := get(QueueNameMain); q != nil {
+		return q
+	}
+	return register(QueueNameMain, maxRunners, reservationTimeout)
+}
+
+// PublicQueue returns the "public" overflow queue, registering it lazily
+// (like NodeQueue) so callers that race Init don't see a nil queue.
+func PublicQueue() *taskq.Queue {
+	if q := get(QueueNamePublic); q != nil {
+		return q
+	}
+	return register(QueueNamePublic, maxRunners*2, reservationTimeout)
+}
+
+// NodeQueue returns the node-affinity queue for nodeId, registering it
+// with the factory on first use.
+func NodeQueue(nodeId string) *taskq.Queue {
+	name := nodeQueuePrefix + nodeId
+	if q := get(name); q != nil {
+		return q
+	}
+	return register(name, maxRunners, 5*time.Minute)
+}
+
+// Queue returns the registered queue with the given name, or nil if no
+// queue by that name has been registered yet.
+func Queue(name string) *taskq.Queue {
+	return get(name)
+}
+
+// Names returns the names of every queue registered so far (main, public,
+// and any node-affinity queues NodeQueue has lazily created).
+func Names() (names []string) {
+	mu.RLock()
+	defer mu.RUnlock()
+	for name := range queues {
+		names = append(names, name)
+	}
+	return names
+}
+
+// Assign enqueues taskId for immediate dispatch on q, deduplicated by
+// task id so the same task can never be in flight twice.
+func Assign(q *taskq.Queue, taskId primitive.ObjectID) (err error) {
+	return AssignAt(q, taskId, time.Time{})
+}
+
+// AssignAt enqueues taskId on q to be dispatched at (or after) at. A zero
+// at dispatches as soon as a worker is available. This lets cron-triggered
+// schedules submit tasks ahead of time.
+func AssignAt(q *taskq.Queue, taskId primitive.ObjectID, at time.Time) (err error) {
+	msg := taskq.NewMessage(context.Background(), taskId.Hex())
+	msg.TaskName = taskName
+	msg.Name = taskId.Hex() // unique key: the same task id can't be queued twice
+	if !at.IsZero() {
+		if d := time.Until(at); d > 0 {
+			msg.Delay = d
+		}
+	}
+	return q.Add(msg)
+}
+
+func handle(taskIdHex string) (err error) {
+	if dispatch == nil {
+		return constants.ErrNotImplemented
+	}
+
+	taskId, err := primitive.ObjectIDFromHex(taskIdHex)
+	if err != nil {
+		return err
+	}
+
+	return dispatch(taskId)
+}
+
+// deadLetter runs once a message has exhausted its retries; it flips the
+// task to StatusError with the failure reason instead of redelivering it
+// forever.
+func deadLetter(msg *taskq.Message) (err error) {
+	taskIdHex, _ := msg.Args[0].(string)
+	taskId, err := primitive.ObjectIDFromHex(taskIdHex)
+	if err != nil {
+		return err
+	}
+
+	t, err := model.TaskService.GetById(taskId)
+	if err != nil {
+		return err
+	}
+
+	t.Status = constants.StatusError
+	if msg.Err != nil {
+		t.Error = msg.Err.Error()
+	}
+
+	if err := t.Save(); err != nil {
+		log.Error("dead-letter task (_id=" + taskIdHex + ") save error: " + err.Error())
+		return err
+	}
+
+	return nil
+}
+
+func register(name string, bufferSize int, reservationTimeout time.Duration) *taskq.Queue {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if q, ok := queues[name]; ok {
+		return q
+	}
+
+	q := factory.RegisterQueue(&taskq.QueueOptions{
+		Name:               name,
+		Redis:              redis.RedisClient.Client(),
+		BufferSize:         bufferSize,
+		ReservationTimeout: reservationTimeout,
+	})
+	queues[name] = q
+	return q
+}
+
+func get(name string) *taskq.Queue {
+	mu.RLock()
+	defer mu.RUnlock()
+	return queues[name]
+}
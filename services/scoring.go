@@ -0,0 +1,85 @@
+package services
+
+import (
+	"time"
+
+	"github.com/crawlab-team/crawlab-core/model"
+)
+
+// trigger sources for a task candidate
+const (
+	TriggerSourceCron   = "cron"
+	TriggerSourceManual = "manual"
+	TriggerSourceTry    = "try"
+)
+
+// scoring weights used by TaskCandidate.Score. These are fixed constants;
+// TaskServiceOptions has no field to override them.
+const (
+	CandidateScoreForceRun       = 100 // bonus for manual/forced runs
+	CandidateScoreTryJob         = 10  // bonus for try/one-shot runs
+	CandidateScoreRetryPenalty   = 5   // penalty per retry
+	CandidateScoreDecayPerMinute = 1   // decay bonus per minute waiting in queue
+)
+
+// TaskCandidate wraps a pending model.Task with the extra metadata needed
+// to rank it against other pending tasks before dispatch.
+type TaskCandidate struct {
+	Task          model.Task
+	Priority      int       // base priority, 0 (lowest) - 10 (highest)
+	EnqueuedAt    time.Time // time the task was enqueued
+	Forced        bool      // whether the task was force-run (manual override)
+	TriggerSource string    // cron / manual / try
+	RetryCount    int       // number of times this task has been re-queued
+}
+
+// NewTaskCandidate builds a TaskCandidate from a model.Task, stamping
+// EnqueuedAt with the current time.
+func NewTaskCandidate(t model.Task) (c *TaskCandidate) {
+	return &TaskCandidate{
+		Task:          t,
+		Priority:      t.Priority,
+		EnqueuedAt:    time.Now(),
+		Forced:        t.Forced,
+		TriggerSource: t.TriggerSource,
+		RetryCount:    t.RetryCount,
+	}
+}
+
+// Score computes the scheduling score for the candidate. Higher scores are
+// dispatched first: TaskService.AssignAt stores it in a per-queue Redis
+// sorted set, and promoterLoop re-scores and ZPOPMAX's that set on a timer
+// to pick the next candidates to hand off to taskq (see task.go). The
+// score is the sum of staticScore and a decay term proportional to time
+// waiting, so starved tasks eventually win.
+func (c *TaskCandidate) Score() (score float64) {
+	score = c.staticScore()
+
+	if !c.EnqueuedAt.IsZero() {
+		score += time.Since(c.EnqueuedAt).Minutes() * CandidateScoreDecayPerMinute
+	}
+
+	return score
+}
+
+// staticScore is the part of Score that does not depend on elapsed wait
+// time: a base component from Priority (0-10), a bonus for manual/forced
+// runs, a bonus for try/one-shot runs, and a penalty proportional to
+// RetryCount. TaskService.AssignAt caches this once at enqueue time so
+// promote doesn't need to re-fetch the task from Mongo on every tick just
+// to recompute it.
+func (c *TaskCandidate) staticScore() (score float64) {
+	score = float64(c.Priority)
+
+	if c.Forced || c.TriggerSource == TriggerSourceManual {
+		score += CandidateScoreForceRun
+	}
+
+	if c.TriggerSource == TriggerSourceTry {
+		score += CandidateScoreTryJob
+	}
+
+	score -= float64(c.RetryCount) * CandidateScoreRetryPenalty
+
+	return score
+}
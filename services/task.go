@@ -1,16 +1,19 @@
 package services
 
 import (
-	"encoding/json"
 	"fmt"
 	"github.com/apex/log"
 	"github.com/crawlab-team/crawlab-core/constants"
-	"github.com/crawlab-team/crawlab-core/entity"
 	"github.com/crawlab-team/crawlab-core/model"
+	"github.com/crawlab-team/crawlab-core/services/blacklist"
+	"github.com/crawlab-team/crawlab-core/services/queue"
 	"github.com/crawlab-team/crawlab-core/utils"
 	"github.com/crawlab-team/crawlab-db/redis"
+	"github.com/vmihailenco/taskq/v3"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	mongo2 "go.mongodb.org/mongo-driver/mongo"
+	"strconv"
 	"sync"
 	"time"
 )
@@ -22,14 +25,18 @@ type TaskServiceInterface interface {
 	Fetch() (t model.Task, err error)
 	Run(taskId string) (err error)
 	Cancel(taskId string) (err error)
+	Extend(taskId primitive.ObjectID) (err error)
 	FindLogs(id string, pattern string, skip, size int) (lines []string, err error)
 }
 
 type TaskServiceOptions struct {
-	IsMaster        bool        // whether TaskService is on master node
-	MaxRunners      int         // max TaskRunner count that can run on TaskService, default: 8
-	PollWaitSeconds int         // number of seconds that TaskService.Fetch will be executed, default: 5
-	Node            *model.Node // Node where TaskService is running
+	IsMaster           bool        // whether TaskService is on master node
+	MaxRunners         int         // max TaskRunner count that can run on TaskService, default: 8
+	PollWaitSeconds    int         // number of seconds that TaskService.Fetch will be executed, default: 5
+	Node               *model.Node // Node where TaskService is running
+	LeaseTTLSeconds    int         // TTL of a running task's lease key, default: 60
+	LeaseExtendSeconds int         // how often the lease is renewed while a task runs, default: 30
+	MaxRetries         int         // max times a task may be requeued after its lease expires, default: 3
 }
 
 func NewTaskService(options *TaskServiceOptions) (s *TaskService, err error) {
@@ -50,27 +57,79 @@ func NewTaskService(options *TaskServiceOptions) (s *TaskService, err error) {
 		options.PollWaitSeconds = 5
 	}
 
+	// normalize LeaseTTLSeconds
+	if options.LeaseTTLSeconds == 0 {
+		options.LeaseTTLSeconds = 60
+	}
+
+	// normalize LeaseExtendSeconds
+	if options.LeaseExtendSeconds == 0 {
+		options.LeaseExtendSeconds = 30
+	}
+
+	// normalize MaxRetries
+	if options.MaxRetries == 0 {
+		options.MaxRetries = 3
+	}
+
 	// construct TaskService
+	// blacklist service, consulted by Assign/Fetch before a task is scheduled
+	blacklistSvc, err := blacklist.NewBlacklistService(nil)
+	if err != nil {
+		return nil, err
+	}
+
 	s = &TaskService{
 		runnersCount: 0,
 		runners:      sync.Map{},
 		opts:         options,
+		blacklistSvc: blacklistSvc,
+		ready:        make(chan primitive.ObjectID, options.MaxRunners*4),
 	}
 
 	return s, nil
 }
 
 type TaskService struct {
-	runnersCount int                 // number of task runners
-	runners      sync.Map            // pool of task runners started
-	active       bool                // whether the task service is active
-	opts         *TaskServiceOptions // options
+	runnersCount int                         // number of task runners
+	runners      sync.Map                    // pool of task runners started
+	active       bool                        // whether the task service is active
+	opts         *TaskServiceOptions         // options
+	blacklistSvc *blacklist.BlacklistService // blacklist rules consulted by Assign/Fetch
+	ready        chan primitive.ObjectID     // task ids handed off by the taskq dispatcher, drained by Fetch
 }
 
 func (s *TaskService) Init() (err error) {
 	// set TaskService.active to true
 	s.active = true
 
+	// start the blacklist service's background refresh loop
+	if err := s.blacklistSvc.Init(); err != nil {
+		return err
+	}
+
+	// start the taskq consumers backing Assign/Fetch; reserved messages are
+	// handed off to s.ready for Fetch to drain, keeping Fetch's pull-based
+	// shape while taskq owns retries, delay, and the dead-letter handler
+	if err := queue.Init(&queue.Options{
+		MaxRunners: s.opts.MaxRunners,
+		Dispatch: func(taskId primitive.ObjectID) error {
+			s.ready <- taskId
+			return nil
+		},
+	}); err != nil {
+		return err
+	}
+
+	// on master, start the reaper loop that requeues tasks whose worker
+	// went away without renewing its lease, and the promoter loop that
+	// ranks pending candidates by TaskCandidate.Score before handing them
+	// to taskq (see AssignAt)
+	if s.opts.IsMaster {
+		go s.reaperLoop()
+		go s.promoterLoop()
+	}
+
 	for {
 		// stop if TaskService.active is set to false
 		if !s.active {
@@ -111,36 +170,85 @@ func (s *TaskService) Init() (err error) {
 
 func (s *TaskService) Close() {
 	s.active = false
+	s.blacklistSvc.Close()
 }
 
+// Assign enqueues t for immediate dispatch. See AssignAt for scheduling a
+// task ahead of time.
 func (s *TaskService) Assign(t model.Task) (err error) {
+	return s.AssignAt(t, time.Time{})
+}
+
+// AssignAt enqueues t to become eligible for dispatch at (or after) at. A
+// zero at dispatches as soon as a worker is available; this is what lets
+// cron-triggered schedules submit tasks ahead of their run time.
+//
+// Delivery itself sits on github.com/vmihailenco/taskq (redisq backend,
+// see services/queue) rather than raw RPush/LPop: taskq gives us
+// exponential-backoff retries, a reservation timeout, and a dead-letter
+// handler that flips the task to StatusError once retries are exhausted.
+// The node-affinity queue naming ("tasks:node:<id>") is unchanged; queue.go
+// just registers it as a taskq queue instead of a plain Redis list.
+//
+// taskq itself only delivers FIFO, so ranking by TaskCandidate.Score is
+// done a layer above it: a task scheduled for "now" is parked in a
+// per-queue Redis sorted set (scored by Score) instead of being handed to
+// taskq directly, and promoterLoop periodically re-scores that set against
+// each candidate's real elapsed wait time and hands the current highest
+// scorer to taskq. A task scheduled for later (at is non-zero, e.g. a cron
+// submission) skips the sorted set and uses taskq's own Delay, since it
+// isn't competing on priority yet.
+func (s *TaskService) AssignAt(t model.Task, at time.Time) (err error) {
 	// validate options
 	if !s.opts.IsMaster {
 		return constants.ErrForbidden
 	}
 
-	// task message
-	msg := entity.TaskMessage{
-		Id: t.Id,
-	}
-
-	// serialization
-	msgStr, err := msg.ToString()
-	if err != nil {
-		return err
+	// reject if a blacklist rule matches, recording the rule name on the
+	// task document for later audit
+	if rule, ok := s.blacklistSvc.Match(t); ok {
+		t.BlacklistRuleName = rule.Name
+		if err := s.saveTask(t, constants.StatusError); err != nil {
+			return err
+		}
+		return constants.ErrTaskBlacklisted
 	}
 
-	// queue name
-	var queue string
+	// pick the queue: node-affinity if NodeId is set, otherwise the shared
+	// "main" queue
+	var q *taskq.Queue
 	if utils.IsObjectIdNull(t.NodeId) {
-		queue = "tasks:public"
+		q = queue.MainQueue()
 	} else {
-		queue = "tasks:node:" + t.NodeId.Hex()
+		q = queue.NodeQueue(t.NodeId.Hex())
 	}
 
-	// enqueue
-	if err := redis.RedisClient.RPush(queue, msgStr); err != nil {
-		return err
+	if !at.IsZero() {
+		// scheduled ahead of time: taskq's own delay is enough, it isn't
+		// ranked against other candidates until it becomes eligible
+		if err := queue.AssignAt(q, t.Id, at); err != nil {
+			return err
+		}
+	} else {
+		// eligible now: park it in the scored pending set so promoterLoop
+		// can rank it against every other immediately-eligible candidate
+		// before handing the winner to taskq. The static part of its score
+		// is cached alongside it so promoterLoop can re-rank every tick
+		// without a Mongo round trip per candidate (see promote).
+		c := NewTaskCandidate(t)
+		if err := redis.RedisClient.SetNX(enqueuedAtKey(t.Id), c.EnqueuedAt.Format(time.RFC3339Nano), pendingCacheTTL); err != nil {
+			return err
+		}
+		// not SetNX: a requeue (see reap) bumps RetryCount and calls
+		// AssignAt again, and the cached static score must reflect that,
+		// unlike enqueuedAtKey which intentionally keeps the original
+		// wait-time baseline across requeues
+		if err := redis.RedisClient.Set(staticScoreKey(t.Id), fmt.Sprintf("%f", c.staticScore()), pendingCacheTTL); err != nil {
+			return err
+		}
+		if err := redis.RedisClient.ZAdd(pendingKey(q.Name()), c.Score(), t.Id.Hex()); err != nil {
+			return err
+		}
 	}
 
 	// set task status as "pending" and save to database
@@ -151,52 +259,234 @@ func (s *TaskService) Assign(t model.Task) (err error) {
 	return nil
 }
 
-func (s *TaskService) Fetch() (t model.Task, err error) {
-	// message
-	var msg string
+// pendingCacheTTL bounds how long a pending task's enqueuedAtKey/
+// staticScoreKey entries live: comfortably longer than any realistic wait
+// in the pending set, so a promote tick never has to treat an expired
+// entry as anything other than "stale, drop it."
+const pendingCacheTTL = 24 * time.Hour
 
-	// fetch task from node queue
-	if s.opts.Node != nil {
-		queueCur := "tasks:node:" + s.opts.Node.Id.Hex()
-		msg, err = redis.RedisClient.LPop(queueCur)
+const promoteInterval = 2 * time.Second
+
+// pendingKey is the per-queue Redis sorted set of task ids waiting to be
+// promoted to taskq, scored by TaskCandidate.Score.
+func pendingKey(queueName string) string {
+	return "tasks:pending:" + queueName
+}
+
+// enqueuedAtKey stores the time a task first entered a pending set, so
+// promote can recompute its decay against the real elapsed wait rather
+// than the instant it happened to be scored at.
+func enqueuedAtKey(taskId primitive.ObjectID) string {
+	return "tasks:pending:enqueued_at:" + taskId.Hex()
+}
+
+// staticScoreKey caches TaskCandidate.staticScore (everything in Score
+// except the decay term) as of the last AssignAt call for taskId, so
+// promote can re-rank every tick without a Mongo round trip per
+// candidate. See AssignAt.
+func staticScoreKey(taskId primitive.ObjectID) string {
+	return "tasks:pending:static_score:" + taskId.Hex()
+}
+
+// promoterLoop periodically re-scores each queue's pending candidates
+// against their real elapsed wait time (see TaskCandidate.Score, whose
+// decay term only means anything if it's re-evaluated while a task is
+// still waiting) and promotes up to promoteBatchSize of the highest
+// scorers per queue, handing each to taskq, which from that point
+// on owns its retries/reservation/dead-lettering.
+func (s *TaskService) promoterLoop() {
+	for s.active {
+		time.Sleep(promoteInterval)
+		if !s.active {
+			return
+		}
+		for _, name := range queue.Names() {
+			if err := s.promote(name); err != nil {
+				log.Error("promote pending tasks for queue " + name + " error: " + err.Error())
+			}
+		}
 	}
+}
 
-	// fetch task from public queue if first fetch is not successful
-	if msg == "" {
-		err = nil
-		queuePub := "tasks:public"
-		msg, err = redis.RedisClient.LPop(queuePub)
+func (s *TaskService) promote(queueName string) (err error) {
+	key := pendingKey(queueName)
+
+	members, err := redis.RedisClient.ZRangeWithScores(key, 0, -1)
+	if err != nil {
+		return err
+	}
+	if len(members) == 0 {
+		return nil
+	}
+
+	// refresh every candidate's score against its real elapsed wait time
+	// before picking winners, so a task that has been starved keeps
+	// climbing even though its static score never changes between ticks.
+	// Both the static score and enqueue time are read back from the Redis
+	// cache populated by AssignAt, not Mongo, so this stays cheap even
+	// with a deep pending set; a cache miss means the entry outlived
+	// pendingCacheTTL or was never ours, so it is dropped rather than
+	// re-fetched from the database.
+	for _, m := range members {
+		taskId, err := primitive.ObjectIDFromHex(m.Member)
 		if err != nil {
-			return t, err
+			continue
+		}
+
+		staticScore, err := s.loadStaticScore(taskId)
+		if err != nil {
+			if err := redis.RedisClient.ZRem(key, m.Member); err != nil {
+				log.Error(fmt.Sprintf("drop stale pending task (_id=%s) error: %s", taskId.Hex(), err.Error()))
+			}
+			continue
+		}
+
+		score := staticScore
+		if enqueuedAt, err := s.loadEnqueuedAt(taskId); err == nil {
+			score += time.Since(enqueuedAt).Minutes() * CandidateScoreDecayPerMinute
+		}
+
+		if err := redis.RedisClient.ZAdd(key, score, m.Member); err != nil {
+			log.Error(fmt.Sprintf("re-score pending task (_id=%s) error: %s", taskId.Hex(), err.Error()))
 		}
 	}
 
-	// no task fetched
-	if msg == "" {
-		return t, constants.ErrNoTasksAvailable
+	// drain up to promoteBatchSize winners this tick, instead of capping
+	// every queue at one promotion per tick; the batch size is fixed and
+	// does not depend on how many runners are currently busy
+	q := queue.Queue(queueName)
+	if q == nil {
+		return nil
 	}
 
-	// deserialization
-	tMsg := entity.TaskMessage{}
-	if err := json.Unmarshal([]byte(msg), &tMsg); err != nil {
+	for i := 0; i < s.promoteBatchSize(); i++ {
+		member, err := redis.RedisClient.ZPopMax(key)
+		if err != nil {
+			return err
+		}
+		if member == "" {
+			break
+		}
+
+		taskId, err := primitive.ObjectIDFromHex(member)
+		if err != nil {
+			continue
+		}
+
+		if err := queue.Assign(q, taskId); err != nil {
+			log.Error(fmt.Sprintf("promote task (_id=%s) to queue %s error: %s", taskId.Hex(), queueName, err.Error()))
+		}
+	}
+
+	return nil
+}
+
+// promoteBatchSize bounds how many candidates a single promote call hands
+// to taskq: the same multiple of MaxRunners used to size s.ready's buffer,
+// so a tick can fill all of this node's idle capacity instead of trickling
+// one task out every promoteInterval no matter how much is waiting.
+func (s *TaskService) promoteBatchSize() int {
+	return s.opts.MaxRunners * 4
+}
+
+func (s *TaskService) loadEnqueuedAt(taskId primitive.ObjectID) (t time.Time, err error) {
+	val, err := redis.RedisClient.Get(enqueuedAtKey(taskId))
+	if err != nil {
 		return t, err
 	}
+	return time.Parse(time.RFC3339Nano, val)
+}
+
+func (s *TaskService) loadStaticScore(taskId primitive.ObjectID) (score float64, err error) {
+	val, err := redis.RedisClient.Get(staticScoreKey(taskId))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(val, 64)
+}
+
+// Fetch drains the next task id handed off by the taskq consumers started
+// in Init (see queue.go) and loads the corresponding model.Task. It
+// returns constants.ErrNoTasksAvailable if nothing has been dispatched
+// within PollWaitSeconds, keeping its previous pull-based signature even
+// though dispatch is push-based internally now.
+func (s *TaskService) Fetch() (t model.Task, err error) {
+	var taskId primitive.ObjectID
+	select {
+	case taskId = <-s.ready:
+	case <-time.After(time.Duration(s.opts.PollWaitSeconds) * time.Second):
+		return t, constants.ErrNoTasksAvailable
+	}
 
 	// fetch task
-	t, err = model.TaskService.GetById(tMsg.Id)
+	t, err = model.TaskService.GetById(taskId)
 	if err != nil {
 		return t, err
 	}
 
+	// re-check the blacklist: a rule may have been added while the task
+	// was sitting in the queue
+	if rule, ok := s.blacklistSvc.Match(t); ok {
+		t.BlacklistRuleName = rule.Name
+		if err := s.saveTask(t, constants.StatusError); err != nil {
+			return t, err
+		}
+		return t, constants.ErrTaskBlacklisted
+	}
+
+	// write the lease key so the reaper knows this task is claimed; its
+	// TTL is renewed by a goroutine started in Run while the task executes
+	if err := s.acquireLease(t.Id); err != nil {
+		return t, err
+	}
+
 	return t, nil
 }
 
-func (s *TaskService) Run(taskId primitive.ObjectID) (err error) {
-	_, ok := s.runners.Load(taskId)
-	if ok {
-		return constants.ErrAlreadyExists
+// acquireLease writes the lease key that tells the reaper a task is
+// claimed and alive; its TTL is renewed by a goroutine started in Run
+// while the task executes. Shared by Fetch (tasks dispatched through
+// Assign/taskq) and Run (tasks started directly by a manual/try-run
+// trigger, which never goes through Fetch at all and so would otherwise
+// get no lease, making the reaper requeue it as if its worker had died
+// while it was still running).
+func (s *TaskService) acquireLease(taskId primitive.ObjectID) (err error) {
+	nodeId := ""
+	if s.opts.Node != nil {
+		nodeId = s.opts.Node.Id.Hex()
 	}
+	ttl := time.Duration(s.opts.LeaseTTLSeconds) * time.Second
+	return redis.RedisClient.SetNX(leaseKey(taskId), nodeId, ttl)
+}
+
+// Extend renews the lease TTL for a running task. The lease-renewal
+// goroutine started by Run calls this on a timer for as long as the task is
+// executing; if Cancel has deleted the
+// lease key in the meantime, Extend returns constants.ErrNotExists so the
+// runner can shut down gracefully instead of racing the reaper.
+//
+// It is declared on TaskServiceInterface alongside Run/Cancel/FindLogs so
+// it is exposed the same way those already are; this trimmed tree does not
+// carry the grpc/server package that wires TaskServiceInterface to RPCs,
+// so there is no separate handler to add here.
+func (s *TaskService) Extend(taskId primitive.ObjectID) (err error) {
+	ok, err := redis.RedisClient.Exists(leaseKey(taskId))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return constants.ErrNotExists
+	}
+	ttl := time.Duration(s.opts.LeaseTTLSeconds) * time.Second
+	return redis.RedisClient.Expire(leaseKey(taskId), ttl)
+}
 
+// Run starts a TaskRunner for taskId. queue.AssignAt's unique message key
+// only dedupes at enqueue time; Run is a separate public entry point on
+// TaskServiceInterface that manual/try-run triggers can call directly,
+// bypassing Assign entirely, so it needs its own guard against the same
+// task id being run twice concurrently.
+func (s *TaskService) Run(taskId primitive.ObjectID) (err error) {
 	// create a new task runner
 	r, err := NewTaskRunner(&TaskRunnerOptions{
 		TaskId: taskId,
@@ -205,12 +495,52 @@ func (s *TaskService) Run(taskId primitive.ObjectID) (err error) {
 		return err
 	}
 
-	// save runner to pool
-	s.runners.Store(taskId, r)
+	// reserve this taskId atomically; LoadOrStore (not Load then Store)
+	// so two concurrent callers can't both pass the check before either
+	// has stored its runner
+	if _, loaded := s.runners.LoadOrStore(taskId, r); loaded {
+		return constants.ErrAlreadyExists
+	}
 	s.runnersCount++
 
+	// establish the lease ourselves: a task dispatched through Fetch
+	// already has one (acquireLease is a no-op via SetNX in that case),
+	// but a manual/try-run trigger calling Run directly never went
+	// through Fetch at all
+	if err := s.acquireLease(taskId); err != nil {
+		s.runners.Delete(taskId)
+		s.runnersCount--
+		return err
+	}
+
+	// done signals the lease-extension goroutine to stop once the runner
+	// below finishes, errors, or is cancelled
+	done := make(chan struct{})
+
+	// periodically renew the task's lease so the master's reaper does not
+	// mistake a healthy worker for a crashed one
+	go func() {
+		interval := time.Duration(s.opts.LeaseExtendSeconds) * time.Second
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := s.Extend(taskId); err != nil {
+					log.Error(fmt.Sprintf("extend lease for task (_id=%s) error: %s", taskId.Hex(), err.Error()))
+					return
+				}
+			}
+		}
+	}()
+
 	// create a goroutine to run task
 	go func() {
+		// stop renewing the lease once the task runner ends
+		defer close(done)
+
 		// run task process (blocking)
 		// error or finish after task runner ends
 		if err := r.Run(); err != nil {
@@ -238,6 +568,17 @@ func (s *TaskService) Cancel(taskId string) (err error) {
 	if err := r.Cancel(); err != nil {
 		return err
 	}
+
+	// delete the lease key so the runner's next Extend call returns
+	// constants.ErrNotExists and it shuts down gracefully
+	oid, err := primitive.ObjectIDFromHex(taskId)
+	if err != nil {
+		return err
+	}
+	if err := redis.RedisClient.Del(leaseKey(oid)); err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -267,6 +608,65 @@ func (s *TaskService) getTaskRunner(taskId string) (r *TaskRunner, err error) {
 	return r, nil
 }
 
+// reaperLoop periodically scans for tasks stuck in StatusRunning whose
+// lease key has disappeared (the worker that held them is presumed dead)
+// and requeues them, bumping their retry counter.
+func (s *TaskService) reaperLoop() {
+	for s.active {
+		time.Sleep(time.Duration(s.opts.LeaseTTLSeconds) * time.Second)
+		if !s.active {
+			return
+		}
+		if err := s.reap(); err != nil {
+			log.Error("reap expired task leases error: " + err.Error())
+		}
+	}
+}
+
+func (s *TaskService) reap() (err error) {
+	tasks, err := model.TaskService.GetList(bson.M{"status": constants.StatusRunning}, nil)
+	if err != nil {
+		return err
+	}
+
+	for _, t := range tasks {
+		ok, err := redis.RedisClient.Exists(leaseKey(t.Id))
+		if err != nil {
+			log.Error(fmt.Sprintf("check lease for task (_id=%s) error: %s", t.Id.Hex(), err.Error()))
+			continue
+		}
+		if ok {
+			// lease still held, worker is alive
+			continue
+		}
+
+		if !shouldRequeue(t.RetryCount, s.opts.MaxRetries) {
+			if err := s.saveTask(t, constants.StatusError); err != nil {
+				log.Error(fmt.Sprintf("mark task (_id=%s) as error error: %s", t.Id.Hex(), err.Error()))
+			}
+			continue
+		}
+
+		t.RetryCount++
+		if err := s.Assign(t); err != nil {
+			log.Error(fmt.Sprintf("requeue task (_id=%s) error: %s", t.Id.Hex(), err.Error()))
+		}
+	}
+
+	return nil
+}
+
+// shouldRequeue reports whether a task whose lease has expired still has
+// retries left, or has exhausted MaxRetries and should be marked as
+// permanently failed instead.
+func shouldRequeue(retryCount, maxRetries int) (ok bool) {
+	return retryCount < maxRetries
+}
+
+func leaseKey(taskId primitive.ObjectID) string {
+	return "tasks:lease:" + taskId.Hex()
+}
+
 func (s *TaskService) saveTask(t model.Task, status string) (err error) {
 	// normalize status
 	if status == "" {
@@ -0,0 +1,29 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestShouldRequeue(t *testing.T) {
+	require.True(t, shouldRequeue(0, 3))
+	require.True(t, shouldRequeue(2, 3))
+	require.False(t, shouldRequeue(3, 3))
+	require.False(t, shouldRequeue(4, 3))
+}
+
+func TestLeaseKey(t *testing.T) {
+	id := primitive.NewObjectID()
+	require.Equal(t, "tasks:lease:"+id.Hex(), leaseKey(id))
+}
+
+func TestPendingKey(t *testing.T) {
+	require.Equal(t, "tasks:pending:main", pendingKey("main"))
+}
+
+func TestEnqueuedAtKey(t *testing.T) {
+	id := primitive.NewObjectID()
+	require.Equal(t, "tasks:pending:enqueued_at:"+id.Hex(), enqueuedAtKey(id))
+}
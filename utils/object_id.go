@@ -0,0 +1,9 @@
+package utils
+
+import "go.mongodb.org/mongo-driver/bson/primitive"
+
+// IsObjectIdNull reports whether id is the zero-value ObjectID, i.e. it
+// was never set.
+func IsObjectIdNull(id primitive.ObjectID) (ok bool) {
+	return id.IsZero()
+}